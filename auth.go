@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// injectedAPIKey, when non-empty, is sent as "Authorization: Bearer
+// <injectedAPIKey>" on every outbound request, overwriting whatever the
+// client supplied. Set once in main from -api-key / LETTA_API_KEY.
+var injectedAPIKey string
+
+// injectAPIKey overwrites req's Authorization header with the proxy's own
+// Letta credential, if one is configured. This lets the proxy act as a
+// credential broker: clients never need to know the real server key.
+func injectAPIKey(req *http.Request) {
+	if injectedAPIKey == "" {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+injectedAPIKey)
+}
+
+// ClientPermissions restricts what an authenticated client may do. An empty
+// slice for either field means "no restriction" on that dimension.
+type ClientPermissions struct {
+	AllowedPathPrefixes []string `json:"allowed_path_prefixes,omitempty"`
+	AllowedMethods      []string `json:"allowed_methods,omitempty"`
+}
+
+// clientAuthFile is the on-disk shape of -client-auth-file: a JSON object
+// mapping a client credential to its permissions. The credential is either a
+// bearer token or a "user:password" pair for HTTP Basic.
+type clientAuthFile struct {
+	Clients map[string]ClientPermissions `json:"clients"`
+}
+
+// ClientAuth authenticates inbound requests against a set of known client
+// credentials loaded from -client-auth-file, and checks their permissions.
+type ClientAuth struct {
+	clients map[string]ClientPermissions
+}
+
+// loadClientAuth reads and parses the client auth file at path. A path of ""
+// means per-client authentication is disabled, returning (nil, nil).
+func loadClientAuth(path string) (*ClientAuth, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed clientAuthFile
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	return &ClientAuth{clients: parsed.Clients}, nil
+}
+
+// credential extracts the bearer token or "user:password" Basic credential
+// presented by r, or "" if the request has neither.
+func credential(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		return user + ":" + pass
+	}
+	return ""
+}
+
+// authenticate checks r's credential against the known clients and, for a
+// recognized client, that its permissions allow this method and path. It
+// returns the matched permissions and an HTTP status to fail with - 0 means
+// the request is allowed, 401 means the credential is missing or unknown,
+// and 403 means a known client isn't permitted to do this.
+func (a *ClientAuth) authenticate(r *http.Request) (ClientPermissions, int) {
+	cred := credential(r)
+	if cred == "" {
+		return ClientPermissions{}, http.StatusUnauthorized
+	}
+
+	perms, ok := a.clients[cred]
+	if !ok {
+		return ClientPermissions{}, http.StatusUnauthorized
+	}
+
+	if len(perms.AllowedMethods) > 0 && !containsFold(perms.AllowedMethods, r.Method) {
+		return perms, http.StatusForbidden
+	}
+	if len(perms.AllowedPathPrefixes) > 0 && !hasAnyPrefix(r.URL.Path, perms.AllowedPathPrefixes) {
+		return perms, http.StatusForbidden
+	}
+	return perms, 0
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// middleware wraps next with client authentication: requests are checked
+// against the known clients before being forwarded, and the client's own
+// Authorization header is stripped so it never reaches the upstream -
+// injectAPIKey (or nothing, if no server key is configured) takes its place.
+func (a *ClientAuth) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, status := a.authenticate(r); status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		r.Header.Del("Authorization")
+		next(w, r)
+	}
+}
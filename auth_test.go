@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testClientAuth() *ClientAuth {
+	return &ClientAuth{clients: map[string]ClientPermissions{
+		"secrettoken":   {},
+		"restricted":    {AllowedPathPrefixes: []string{"/v1/agents"}, AllowedMethods: []string{"GET"}},
+		"alice:hunter2": {},
+	}}
+}
+
+func TestClientAuthAuthenticateMissingCredential(t *testing.T) {
+	a := testClientAuth()
+	r := httptest.NewRequest(http.MethodGet, "/v1/agents", nil)
+
+	if _, status := a.authenticate(r); status != http.StatusUnauthorized {
+		t.Errorf("authenticate with no credential: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestClientAuthAuthenticateUnknownToken(t *testing.T) {
+	a := testClientAuth()
+	r := httptest.NewRequest(http.MethodGet, "/v1/agents", nil)
+	r.Header.Set("Authorization", "Bearer nope")
+
+	if _, status := a.authenticate(r); status != http.StatusUnauthorized {
+		t.Errorf("authenticate with unknown token: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestClientAuthAuthenticateUnrestrictedClient(t *testing.T) {
+	a := testClientAuth()
+	r := httptest.NewRequest(http.MethodDelete, "/v1/anything", nil)
+	r.Header.Set("Authorization", "Bearer secrettoken")
+
+	if _, status := a.authenticate(r); status != 0 {
+		t.Errorf("authenticate for a client with no restrictions: got status %d, want 0 (allowed)", status)
+	}
+}
+
+func TestClientAuthAuthenticateBasicCredential(t *testing.T) {
+	a := testClientAuth()
+	r := httptest.NewRequest(http.MethodGet, "/v1/agents", nil)
+	r.SetBasicAuth("alice", "hunter2")
+
+	if _, status := a.authenticate(r); status != 0 {
+		t.Errorf("authenticate with a known user:password credential: got status %d, want 0 (allowed)", status)
+	}
+}
+
+func TestClientAuthAuthenticateMethodNotAllowed(t *testing.T) {
+	a := testClientAuth()
+	r := httptest.NewRequest(http.MethodPost, "/v1/agents", nil)
+	r.Header.Set("Authorization", "Bearer restricted")
+
+	if _, status := a.authenticate(r); status != http.StatusForbidden {
+		t.Errorf("authenticate with a disallowed method: got status %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestClientAuthAuthenticatePathNotAllowed(t *testing.T) {
+	a := testClientAuth()
+	r := httptest.NewRequest(http.MethodGet, "/v1/blocking", nil)
+	r.Header.Set("Authorization", "Bearer restricted")
+
+	if _, status := a.authenticate(r); status != http.StatusForbidden {
+		t.Errorf("authenticate with a disallowed path: got status %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestClientAuthAuthenticateAllowedPathAndMethod(t *testing.T) {
+	a := testClientAuth()
+	r := httptest.NewRequest(http.MethodGet, "/v1/agents/123/messages", nil)
+	r.Header.Set("Authorization", "Bearer restricted")
+
+	if _, status := a.authenticate(r); status != 0 {
+		t.Errorf("authenticate within the allowed path/method: got status %d, want 0 (allowed)", status)
+	}
+}
+
+func TestClientAuthMiddlewareRejectsAndStripsCredential(t *testing.T) {
+	a := testClientAuth()
+
+	var sawAuthHeader string
+	called := false
+	next := func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		sawAuthHeader = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	// An unknown credential never reaches next.
+	rejected := httptest.NewRequest(http.MethodGet, "/v1/agents", nil)
+	rejected.Header.Set("Authorization", "Bearer nope")
+	rw := httptest.NewRecorder()
+	a.middleware(next)(rw, rejected)
+	if called {
+		t.Fatal("middleware called next for an unauthenticated request")
+	}
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("middleware response code for an unknown token: got %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+
+	// A known credential reaches next, with its Authorization header
+	// stripped so it never reaches the upstream in its place.
+	allowed := httptest.NewRequest(http.MethodGet, "/v1/agents", nil)
+	allowed.Header.Set("Authorization", "Bearer secrettoken")
+	rw = httptest.NewRecorder()
+	a.middleware(next)(rw, allowed)
+	if !called {
+		t.Fatal("middleware did not call next for an authenticated request")
+	}
+	if sawAuthHeader != "" {
+		t.Errorf("next saw Authorization header %q, want it stripped", sawAuthHeader)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig configures the proxy's cross-origin behavior. An origin entry
+// wrapped in slashes (e.g. "/^https:\/\/.*\.example\.com$/") is compiled as
+// a regex; anything else is matched literally, with "*" meaning any origin.
+type CORSConfig struct {
+	Origins     []string
+	Methods     []string
+	Headers     []string
+	Expose      []string
+	Credentials bool
+	MaxAge      int
+}
+
+// DefaultCORSConfig mirrors the proxy's previous hardcoded CORS behavior.
+var DefaultCORSConfig = CORSConfig{
+	Origins: []string{"*"},
+	Methods: []string{"GET", "POST", "PUT", "DELETE", "PATCH", "OPTIONS"},
+	Headers: []string{"Authorization", "Content-Type", "Accept", "Origin", "User-Agent", "Cache-Control", "X-Requested-With"},
+	Expose:  []string{"*"},
+	MaxAge:  86400,
+}
+
+// cors compiles a CORSConfig and serves as the single place that decides
+// what Access-Control-* headers a request gets and whether it's a preflight.
+// It replaces the old setCORSHeaders/handleOptions pair, which was called
+// separately - and slightly differently - from proxyRequest, handleFileUpload,
+// and the mux handler.
+type cors struct {
+	cfg           CORSConfig
+	originRegexes []*regexp.Regexp
+}
+
+// validateCORSConfig rejects a configuration that would let every origin
+// make credentialed requests: Credentials with "*" still in Origins means
+// allowedOrigin echoes back whatever Origin a request sent, so any site can
+// read credentialed responses. -cors-credentials's help text says it
+// requires -cors-origins to not be "*"; this enforces that at startup
+// instead of relying on the operator to notice.
+func validateCORSConfig(cfg CORSConfig) error {
+	if !cfg.Credentials {
+		return nil
+	}
+	for _, o := range cfg.Origins {
+		if o == "*" {
+			return errors.New("-cors-credentials requires -cors-origins to not include \"*\"")
+		}
+	}
+	return nil
+}
+
+func newCORS(cfg CORSConfig) *cors {
+	c := &cors{cfg: cfg}
+	for _, o := range cfg.Origins {
+		if strings.HasPrefix(o, "/") && strings.HasSuffix(o, "/") && len(o) > 1 {
+			if re, err := regexp.Compile(o[1 : len(o)-1]); err == nil {
+				c.originRegexes = append(c.originRegexes, re)
+			}
+		}
+	}
+	return c
+}
+
+// allowedOrigin returns the value to send back as
+// Access-Control-Allow-Origin for the given request Origin, or "" if the
+// origin isn't allowed at all.
+func (c *cors) allowedOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, o := range c.cfg.Origins {
+		if o == "*" {
+			if c.cfg.Credentials {
+				// validateCORSConfig rejects this combination at startup;
+				// this is a last-resort fallback rather than the intended
+				// path, since echoing the origin back here would let any
+				// site make credentialed requests.
+				return origin
+			}
+			return "*"
+		}
+		if o == origin {
+			return origin
+		}
+	}
+	for _, re := range c.originRegexes {
+		if re.MatchString(origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// addVary appends value to the Vary header without duplicating it if it's
+// already present. applyHeaders runs twice per request - once in the CORS
+// middleware, again in proxyRequest after the upstream's headers are copied
+// in - and h.Add alone would leave two separate "Vary: Origin" header lines.
+func addVary(h http.Header, value string) {
+	for _, v := range h.Values("Vary") {
+		if v == value {
+			return
+		}
+	}
+	h.Add("Vary", value)
+}
+
+// applyHeaders sets CORS headers for a normal (non-preflight) request.
+func (c *cors) applyHeaders(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	addVary(h, "Origin")
+
+	allowed := c.allowedOrigin(r.Header.Get("Origin"))
+	if allowed == "" {
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", allowed)
+	if len(c.cfg.Expose) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(c.cfg.Expose, ", "))
+	}
+	if c.cfg.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// handlePreflight answers an OPTIONS preflight request directly and reports
+// whether it did so.
+func (c *cors) handlePreflight(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodOptions {
+		return false
+	}
+
+	h := w.Header()
+	addVary(h, "Origin")
+	addVary(h, "Access-Control-Request-Method")
+	addVary(h, "Access-Control-Request-Headers")
+
+	if allowed := c.allowedOrigin(r.Header.Get("Origin")); allowed != "" {
+		h.Set("Access-Control-Allow-Origin", allowed)
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.cfg.Methods, ", "))
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.cfg.Headers, ", "))
+		h.Set("Access-Control-Max-Age", strconv.Itoa(c.cfg.MaxAge))
+		if c.cfg.Credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// middleware wraps next so every request gets CORS headers applied, with
+// preflight requests answered directly instead of reaching next at all.
+func (c *cors) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.handlePreflight(w, r) {
+			return
+		}
+		c.applyHeaders(w, r)
+		next(w, r)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dumpTruncateBytes caps how much of a body (request or response) is kept in
+// a dump record, mainly so a streaming SSE response doesn't get buffered in
+// full just to be logged.
+const dumpTruncateBytes = 2048
+
+// DumpConfig controls the -dump request/response tracing feature.
+type DumpConfig struct {
+	Enabled    bool
+	Bodies     bool
+	Format     string // "json" or "http"
+	Output     string // file path; empty means stdout.
+	MaxSizeMB  int    // rotate Output once it reaches this size.
+	RedactKeys []string
+}
+
+// dumpWriter serializes dump records to the configured destination, rotating
+// the output file once it grows past MaxSizeMB.
+type dumpWriter struct {
+	mu   sync.Mutex
+	out  *os.File
+	path string
+	cfg  DumpConfig
+}
+
+// setupDump prepares the dump writer described by cfg, or returns nil if
+// dumping is disabled or the output file can't be opened.
+func setupDump(cfg DumpConfig) *dumpWriter {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	w := &dumpWriter{cfg: cfg}
+	if cfg.Output == "" || cfg.Output == "stdout" {
+		w.out = os.Stdout
+		return w
+	}
+
+	w.path = cfg.Output
+	f, err := os.OpenFile(cfg.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Error opening dump file %s: %v", cfg.Output, err)
+		return nil
+	}
+	w.out = f
+	return w
+}
+
+// rotateIfNeeded renames the current dump file aside once it crosses
+// MaxSizeMB and opens a fresh one in its place. Callers must hold w.mu.
+func (w *dumpWriter) rotateIfNeeded() {
+	if w.path == "" || w.cfg.MaxSizeMB <= 0 {
+		return
+	}
+	info, err := w.out.Stat()
+	if err != nil || info.Size() < int64(w.cfg.MaxSizeMB)<<20 {
+		return
+	}
+
+	w.out.Close()
+	rotated := fmt.Sprintf("%s.%s", w.path, time.Now().UTC().Format("20060102T150405"))
+	if err := os.Rename(w.path, rotated); err != nil {
+		log.Printf("Error rotating dump file %s: %v", w.path, err)
+	}
+
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Error reopening dump file %s after rotation: %v", w.path, err)
+		return
+	}
+	w.out = f
+}
+
+// dumpRecord is one newline-delimited JSON entry written per proxied
+// request/response pair.
+type dumpRecord struct {
+	Time            time.Time           `json:"time"`
+	Method          string              `json:"method"`
+	URL             string              `json:"url"`
+	Status          int                 `json:"status"`
+	LatencyMS       int64               `json:"latency_ms"`
+	RequestHeaders  map[string][]string `json:"request_headers"`
+	ResponseHeaders map[string][]string `json:"response_headers,omitempty"`
+	RequestBody     string              `json:"request_body,omitempty"`
+	ResponseBody    string              `json:"response_body,omitempty"`
+}
+
+// isRedacted reports whether name is one of the configured header names to
+// mask in dump output.
+func (w *dumpWriter) isRedacted(name string) bool {
+	for _, redact := range w.cfg.RedactKeys {
+		if strings.EqualFold(name, redact) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHeaders returns a copy of h with the configured header values
+// replaced by "***".
+func (w *dumpWriter) redactHeaders(h http.Header) map[string][]string {
+	out := make(map[string][]string, len(h))
+	for name, values := range h {
+		if w.isRedacted(name) {
+			out[name] = []string{"***"}
+			continue
+		}
+		out[name] = values
+	}
+	return out
+}
+
+// redactHeader is like redactHeaders but returns an http.Header, for use
+// when building a request/response to pass to httputil.Dump*.
+func (w *dumpWriter) redactHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		out[name] = w.redactHeaders(http.Header{name: values})[name]
+	}
+	return out
+}
+
+// recordJSON writes rec as a newline-delimited JSON entry.
+func (w *dumpWriter) recordJSON(rec dumpRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Error marshaling dump record: %v", err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rotateIfNeeded()
+	w.out.Write(append(data, '\n'))
+}
+
+// recordHTTP writes req/resp in the plain HTTP wire format produced by
+// net/http/httputil, which is handy for diffing against a real client's trace.
+func (w *dumpWriter) recordHTTP(req *http.Request, body []byte, resp *http.Response, respBody []byte) {
+	var buf bytes.Buffer
+
+	reqForDump := req.Clone(req.Context())
+	reqForDump.Header = w.redactHeader(req.Header)
+	includeReqBody := w.cfg.Bodies && body != nil
+	if includeReqBody {
+		body = []byte(truncateBody(body))
+		reqForDump.Body = io.NopCloser(bytes.NewReader(body))
+		reqForDump.ContentLength = int64(len(body))
+	}
+	if dumped, err := httputil.DumpRequestOut(reqForDump, includeReqBody); err == nil {
+		buf.Write(dumped)
+	}
+	buf.WriteString("\n")
+
+	if resp != nil {
+		respForDump := *resp
+		respForDump.Header = w.redactHeader(resp.Header)
+		includeRespBody := w.cfg.Bodies && respBody != nil
+		if includeRespBody {
+			respForDump.Body = io.NopCloser(bytes.NewReader(respBody))
+		}
+		if dumped, err := httputil.DumpResponse(&respForDump, includeRespBody); err == nil {
+			buf.Write(dumped)
+		}
+	}
+	buf.WriteString("\n---\n")
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rotateIfNeeded()
+	w.out.Write(buf.Bytes())
+}
+
+// record logs one proxied request/response pair according to the configured
+// dump format. reqBody/respBody may be nil when the body wasn't captured
+// (e.g. it was streamed straight through); isMultipart marks a request body
+// we deliberately didn't read.
+func (w *dumpWriter) record(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte, latency time.Duration, isMultipart bool) {
+	if w == nil {
+		return
+	}
+
+	if w.cfg.Format == "http" {
+		w.recordHTTP(req, reqBody, resp, respBody)
+		return
+	}
+
+	rec := dumpRecord{
+		Time:           time.Now(),
+		Method:         req.Method,
+		URL:            req.URL.String(),
+		LatencyMS:      latency.Milliseconds(),
+		RequestHeaders: w.redactHeaders(req.Header),
+	}
+	if resp != nil {
+		rec.Status = resp.StatusCode
+		rec.ResponseHeaders = w.redactHeaders(resp.Header)
+	}
+	if w.cfg.Bodies {
+		switch {
+		case isMultipart:
+			rec.RequestBody = "[multipart/form-data, not captured]"
+		case reqBody != nil:
+			rec.RequestBody = truncateBody(reqBody)
+		}
+		if respBody != nil {
+			rec.ResponseBody = truncateBody(respBody)
+		}
+	}
+	w.recordJSON(rec)
+}
+
+// truncateBody trims body to at most dumpTruncateBytes, appending a marker
+// noting how much was cut.
+func truncateBody(body []byte) string {
+	if len(body) <= dumpTruncateBytes {
+		return string(body)
+	}
+	return fmt.Sprintf("%s...[truncated, %d more bytes]", body[:dumpTruncateBytes], len(body)-dumpTruncateBytes)
+}
+
+// cappedBuffer accumulates at most max bytes of whatever passes through it,
+// so it can sit in an io.MultiWriter alongside the real response writer and
+// capture a preview without buffering an entire streaming response.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if remain := c.max - c.buf.Len(); remain > 0 {
+		if len(p) > remain {
+			c.buf.Write(p[:remain])
+			c.truncated = true
+		} else {
+			c.buf.Write(p)
+		}
+	} else if len(p) > 0 {
+		c.truncated = true
+	}
+	return len(p), nil
+}
+
+func (c *cappedBuffer) String() string {
+	if c.truncated {
+		return fmt.Sprintf("%s...[truncated, response continues]", c.buf.String())
+	}
+	return c.buf.String()
+}
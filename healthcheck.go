@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// HealthCheckConfig controls how the background health checker probes
+// upstreams.
+type HealthCheckConfig struct {
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// DefaultHealthCheckConfig mirrors Letta's own health endpoint.
+var DefaultHealthCheckConfig = HealthCheckConfig{
+	Path:     "/v1/health",
+	Interval: 10 * time.Second,
+	Timeout:  2 * time.Second,
+}
+
+// StartHealthChecker launches a background goroutine that periodically
+// probes every upstream in the pool and marks it healthy or unhealthy based
+// on the result. It runs for the lifetime of the process.
+func StartHealthChecker(pool *Pool, cfg HealthCheckConfig) {
+	client := &http.Client{Timeout: cfg.Timeout}
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, u := range pool.Upstreams() {
+				checkUpstream(client, u, cfg.Path)
+			}
+		}
+	}()
+}
+
+// checkUpstream probes a single upstream's health path and updates its
+// healthy flag, logging only on a change of state to avoid spamming the log
+// every interval.
+func checkUpstream(client *http.Client, u *Upstream, path string) {
+	resp, err := client.Get(u.URL + path)
+	if err != nil {
+		if u.IsHealthy() {
+			log.Printf("Upstream %s failed health check: %v", u.URL, err)
+		}
+		u.setHealthy(false)
+		return
+	}
+	defer resp.Body.Close()
+
+	healthy := resp.StatusCode < 500
+	if healthy != u.IsHealthy() {
+		log.Printf("Upstream %s health changed: healthy=%v (status %d)", u.URL, healthy, resp.StatusCode)
+	}
+	u.setHealthy(healthy)
+}
+
+// recordUpstreamResult implements passive circuit-breaking: a request that
+// fails at the transport level (dial/timeout) or comes back with a 5xx marks
+// the upstream unhealthy immediately rather than waiting for the next
+// scheduled probe.
+func recordUpstreamResult(u *Upstream, statusCode int, dialErr error) {
+	if dialErr != nil || statusCode >= 500 {
+		u.setHealthy(false)
+	}
+}
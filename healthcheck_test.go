@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckUpstreamMarksHealthyOn2xx(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	u := newUpstream(srv.URL)
+	u.setHealthy(false)
+	checkUpstream(srv.Client(), u, "/v1/health")
+	if !u.IsHealthy() {
+		t.Error("checkUpstream on a 200 response: got unhealthy, want healthy")
+	}
+}
+
+func TestCheckUpstreamMarksUnhealthyOn5xx(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	u := newUpstream(srv.URL)
+	checkUpstream(srv.Client(), u, "/v1/health")
+	if u.IsHealthy() {
+		t.Error("checkUpstream on a 503 response: got healthy, want unhealthy")
+	}
+}
+
+func TestCheckUpstreamMarksUnhealthyOnDialFailure(t *testing.T) {
+	u := newUpstream("http://127.0.0.1:1") // nothing listens here
+	checkUpstream(http.DefaultClient, u, "/v1/health")
+	if u.IsHealthy() {
+		t.Error("checkUpstream on a dial failure: got healthy, want unhealthy")
+	}
+}
+
+func TestRecordUpstreamResult(t *testing.T) {
+	cases := []struct {
+		name       string
+		statusCode int
+		dialErr    error
+		wantHealth bool
+	}{
+		{"success", http.StatusOK, nil, true},
+		{"client error stays healthy", http.StatusBadRequest, nil, true},
+		{"server error marks unhealthy", http.StatusInternalServerError, nil, false},
+		{"dial error marks unhealthy", 0, errors.New("dial tcp: refused"), false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := newUpstream("http://upstream")
+			recordUpstreamResult(u, tc.statusCode, tc.dialErr)
+			if u.IsHealthy() != tc.wantHealth {
+				t.Errorf("recordUpstreamResult(status=%d, err=%v): got healthy=%v, want %v", tc.statusCode, tc.dialErr, u.IsHealthy(), tc.wantHealth)
+			}
+		})
+	}
+}
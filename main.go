@@ -15,16 +15,44 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
-// Default API server URL. It will be overridden by CLI flag o r env var.
-var targetURL = "http://localhost:8283/v1"
+// Default API server URL, used when nothing else is configured.
+const defaultUpstream = "http://localhost:8283/v1"
 
-// Proxy configuration.
+// pool holds the configured upstream Letta backends. It's set once in main
+// and read concurrently by every request goroutine and the health checker.
+var pool *Pool
+
+// maxUpstreamRetries is how many additional healthy upstreams proxyRequest
+// will try before giving up and returning 502. Set from -lb-retries.
+var maxUpstreamRetries = 1
+
+// activeDump is the request/response tracer enabled by -dump. It's nil when
+// dumping is disabled, which every call site treats as a no-op.
+var activeDump *dumpWriter
+
+// activeCORS is the compiled CORS policy, set once in main and read by the
+// middleware on every request.
+var activeCORS *cors
+
+// activeRateLimiter enforces per-client request rate limits. It's nil when
+// -rate-limit is 0 (the default), which every call site treats as a no-op.
+var activeRateLimiter *RateLimiter
+
+// maxInFlightPerUpstream caps how many requests may be in flight to a single
+// upstream at once; 0 disables the cap. Set from -max-in-flight.
+var maxInFlightPerUpstream int
+
+// Proxy configuration. APIServers is the current, preferred field; APIServer
+// is kept for backward compatibility with config files written by older
+// versions of the proxy that only supported a single backend.
 type Config struct {
-	APIServer string `json:"api_server"`
+	APIServer  string   `json:"api_server,omitempty"`
+	APIServers []string `json:"api_servers,omitempty"`
 }
 
 // getConfigPath returns the path to the configuration file.
@@ -62,13 +90,18 @@ func loadConfig() *Config {
 }
 
 // saveConfig saves the configuration to the user's home directory /home/user/letta-api-server.json, /User/user/letta-api-server.json, C:\Users\user\letta-api-server.json.
-func saveConfig(apiServer string) {
+func saveConfig(apiServers []string) {
 	configPath := getConfigPath()
 	if configPath == "" {
 		return
 	}
 
-	config := Config{APIServer: apiServer}
+	config := Config{APIServers: apiServers}
+	if len(apiServers) == 1 {
+		// Keep the single-server field populated too, so older proxy
+		// versions reading this file still find their one backend.
+		config.APIServer = apiServers[0]
+	}
 	data, err := json.MarshalIndent(config, "", "    ")
 	if err != nil {
 		log.Printf("Error marshaling config: %v", err)
@@ -80,20 +113,116 @@ func saveConfig(apiServer string) {
 	}
 }
 
-// getTargetURL determines the API server URL using the following priority:
-// 1. Environment variable LETTA_API_SERVER.
-// 2. Command line flag -api-server.
+// splitCommaList splits a comma-separated list (upstream URLs, header
+// names, CORS origins, ...), trims whitespace, and drops empty entries.
+func splitCommaList(raw string) []string {
+	var items []string
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		items = append(items, part)
+	}
+	return items
+}
+
+// Settings aggregates everything parsed from CLI flags, environment
+// variables, and the on-disk config file. It's returned once by
+// parseSettings and used to wire up the proxy in main.
+type Settings struct {
+	Upstreams      []string
+	Host           string
+	Port           int
+	LBPolicy       string
+	LBRetries      int
+	HealthCheck    HealthCheckConfig
+	Dump           DumpConfig
+	CORS           CORSConfig
+	APIKey         string
+	ClientAuthFile string
+	RateLimit      float64
+	RateBurst      int
+	RateOverrides  string // raw "-rate-limit-overrides" flag value; parsed in main.
+	TrustedProxies string // raw "-trusted-proxies" flag value; parsed in main.
+	MaxInFlight    int
+	AdminToken     string
+}
+
+// envOrDefault returns the value of the named environment variable, or def
+// if it's unset.
+func envOrDefault(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// parseSettings parses CLI flags and environment variables into a Settings
+// value. The Letta API server list is resolved with the following priority:
+// 1. Environment variable LETTA_API_SERVER (comma-separated).
+// 2. Command line flag -api-server (comma-separated).
 // 3. Saved configuration file.
 // 4. Default value.
-func getTargetURL() (string, string, int) {
+func parseSettings() Settings {
 
 	// Parse command line flags
 	var apiServer string
 	var host string
 	var port int
-	flag.StringVar(&apiServer, "api-server", "", "Letta API server URL (example: http://localhost:8283/v1)")
+	var lbPolicy string
+	var lbRetries int
+	var healthCheckPath string
+	var healthCheckInterval time.Duration
+	var healthCheckTimeout time.Duration
+	var dumpEnabled bool
+	var dumpBodies bool
+	var dumpFormat string
+	var dumpOutput string
+	var dumpMaxSizeMB int
+	var dumpRedact string
+	var corsOrigins string
+	var corsMethods string
+	var corsHeaders string
+	var corsExpose string
+	var corsCredentials bool
+	var corsMaxAge int
+	var apiKey string
+	var clientAuthFile string
+	var rateLimit float64
+	var rateBurst int
+	var rateLimitOverrides string
+	var trustedProxies string
+	var maxInFlight int
+	var adminToken string
+	flag.StringVar(&apiServer, "api-server", "", "Letta API server URL(s), comma-separated (example: http://localhost:8283/v1,http://localhost:8285/v1)")
 	flag.StringVar(&host, "host", "0.0.0.0", "Proxy host to listen on.")
 	flag.IntVar(&port, "port", 8284, "Proxy port to listen on.")
+	flag.StringVar(&lbPolicy, "lb-policy", "round_robin", "Load balancing policy when multiple upstreams are configured: round_robin, random, least_conn, or ip_hash.")
+	flag.IntVar(&lbRetries, "lb-retries", 1, "Number of additional healthy upstreams to try on dial failure before returning 502.")
+	flag.StringVar(&healthCheckPath, "health-check-path", DefaultHealthCheckConfig.Path, "Path probed on each upstream for health checks.")
+	flag.DurationVar(&healthCheckInterval, "health-check-interval", DefaultHealthCheckConfig.Interval, "Interval between upstream health checks.")
+	flag.DurationVar(&healthCheckTimeout, "health-check-timeout", DefaultHealthCheckConfig.Timeout, "Timeout for each upstream health check request.")
+	flag.BoolVar(&dumpEnabled, "dump", envOrDefault("LETTA_PROXY_DUMP", "") != "", "Log full request/response pairs for debugging.")
+	flag.BoolVar(&dumpBodies, "dump-bodies", true, "Include bodies in dump output; false logs headers only.")
+	flag.StringVar(&dumpFormat, "dump-format", "json", "Dump record format: json (newline-delimited JSON) or http (HTTP wire format).")
+	flag.StringVar(&dumpOutput, "dump-output", "", "File to write dump records to; empty means stdout.")
+	flag.IntVar(&dumpMaxSizeMB, "dump-max-size-mb", 100, "Rotate the dump output file once it reaches this size, in megabytes.")
+	flag.StringVar(&dumpRedact, "dump-redact", "Authorization,X-Api-Key,Cookie", "Comma-separated header names to mask in dump output.")
+	flag.StringVar(&corsOrigins, "cors-origins", "*", "Comma-separated list of allowed CORS origins. Use \"*\" for any, or wrap an entry in slashes for a regex.")
+	flag.StringVar(&corsMethods, "cors-methods", strings.Join(DefaultCORSConfig.Methods, ","), "Comma-separated list of methods to allow in CORS preflight responses.")
+	flag.StringVar(&corsHeaders, "cors-headers", strings.Join(DefaultCORSConfig.Headers, ","), "Comma-separated list of request headers to allow in CORS preflight responses.")
+	flag.StringVar(&corsExpose, "cors-expose", strings.Join(DefaultCORSConfig.Expose, ","), "Comma-separated list of response headers to expose to the browser.")
+	flag.BoolVar(&corsCredentials, "cors-credentials", false, "Send Access-Control-Allow-Credentials: true. Requires -cors-origins to not be \"*\".")
+	flag.IntVar(&corsMaxAge, "cors-max-age", DefaultCORSConfig.MaxAge, "Seconds a browser may cache a CORS preflight response.")
+	flag.StringVar(&apiKey, "api-key", os.Getenv("LETTA_API_KEY"), "Letta API key to inject as \"Authorization: Bearer <key>\" on every outbound request, overwriting any client-supplied value.")
+	flag.StringVar(&clientAuthFile, "client-auth-file", "", "JSON file mapping client bearer tokens (or \"user:password\" Basic credentials) to their allowed path prefixes and methods.")
+	flag.Float64Var(&rateLimit, "rate-limit", 0, "Requests/sec allowed per client (identified by auth token, or IP); 0 disables rate limiting.")
+	flag.IntVar(&rateBurst, "rate-burst", 1, "Burst size allowed above -rate-limit per client.")
+	flag.StringVar(&rateLimitOverrides, "rate-limit-overrides", "", "Comma-separated \"prefix:limit:burst\" entries applying a stricter (or looser) limit to matching paths (example: /v1/agents:2:4).")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "Comma-separated CIDRs of proxies trusted to set X-Forwarded-For for rate-limit client identification.")
+	flag.IntVar(&maxInFlight, "max-in-flight", 0, "Max requests in flight to a single upstream at once; 0 disables the cap. Excess requests get 429.")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("LETTA_PROXY_ADMIN_TOKEN"), "Bearer token required to access /admin/rate-limits. The endpoint is disabled unless this is set, independent of -client-auth-file.")
 
 	flag.Parse()
 
@@ -109,60 +238,108 @@ func getTargetURL() (string, string, int) {
 		port = 8284
 	}
 
+	settings := Settings{
+		Host:      host,
+		Port:      port,
+		LBPolicy:  lbPolicy,
+		LBRetries: lbRetries,
+		HealthCheck: HealthCheckConfig{
+			Path:     healthCheckPath,
+			Interval: healthCheckInterval,
+			Timeout:  healthCheckTimeout,
+		},
+		Dump: DumpConfig{
+			Enabled:    dumpEnabled,
+			Bodies:     dumpBodies,
+			Format:     dumpFormat,
+			Output:     dumpOutput,
+			MaxSizeMB:  dumpMaxSizeMB,
+			RedactKeys: splitCommaList(dumpRedact),
+		},
+		CORS: CORSConfig{
+			Origins:     splitCommaList(corsOrigins),
+			Methods:     splitCommaList(corsMethods),
+			Headers:     splitCommaList(corsHeaders),
+			Expose:      splitCommaList(corsExpose),
+			Credentials: corsCredentials,
+			MaxAge:      corsMaxAge,
+		},
+		APIKey:         apiKey,
+		ClientAuthFile: clientAuthFile,
+		RateLimit:      rateLimit,
+		RateBurst:      rateBurst,
+		RateOverrides:  rateLimitOverrides,
+		TrustedProxies: trustedProxies,
+		MaxInFlight:    maxInFlight,
+		AdminToken:     adminToken,
+	}
+
 	// Check environment variable first.
 	if envURL := os.Getenv("LETTA_API_SERVER"); envURL != "" {
-		return strings.TrimSuffix(envURL, "/"), host, port
+		settings.Upstreams = splitCommaList(envURL)
+		return settings
 	}
 
 	// Check command line flag.
 	if apiServer != "" {
-		apiServer = strings.TrimSuffix(apiServer, "/")
-		saveConfig(apiServer) // Save for future use
-		return apiServer, host, port
+		servers := splitCommaList(apiServer)
+		saveConfig(servers) // Save for future use
+		settings.Upstreams = servers
+		return settings
+	}
+
+	// Try to load from config file.
+	if config := loadConfig(); config != nil {
+		if len(config.APIServers) > 0 {
+			settings.Upstreams = config.APIServers
+			return settings
+		}
+		if config.APIServer != "" {
+			settings.Upstreams = []string{config.APIServer}
+			return settings
+		}
 	}
 
-	// Try to load from config file
-	if config := loadConfig(); config != nil && config.APIServer != "" {
-		return config.APIServer, host, port
+	// Fall back to default.
+	settings.Upstreams = []string{defaultUpstream}
+	return settings
+}
+
+// isStreamingResponse reports whether resp should be relayed incrementally
+// rather than buffered, based on the headers the upstream sent back.
+func isStreamingResponse(resp *http.Response) bool {
+	if strings.HasPrefix(strings.ToLower(resp.Header.Get("Content-Type")), "text/event-stream") {
+		return true
+	}
+	for _, enc := range resp.TransferEncoding {
+		if strings.EqualFold(enc, "chunked") {
+			return true
+		}
 	}
+	return false
+}
 
-	// Fall back to default
-	return targetURL, host, port
+// flushWriter wraps an http.ResponseWriter so that every Write is immediately
+// flushed to the underlying connection via http.Flusher. This is required for
+// Server-Sent Events and other chunked, low-latency streams: without it, Go's
+// http.Server (and any buffering in front of it) can hold bytes until the
+// response is complete, defeating the point of streaming.
+type flushWriter struct {
+	http.ResponseWriter
+	flusher http.Flusher
 }
 
-// setCORSHeaders configures Cross-Origin Resource Sharing (CORS) headers.
-// CORS is a security feature that lets browsers know if they're allowed to
-// make requests to our API from different domains/origins.
-func setCORSHeaders(w http.ResponseWriter) {
-	// Allow requests from any website/domain.
-	// In production, you might want to restrict this to specific domains.
-	origin := "*"
-	w.Header().Set("Access-Control-Allow-Origin", origin)
-
-	// Tell browsers which HTTP methods are allowed.
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, PATCH, OPTIONS")
-
-	// Tell browsers which headers they can include in requests.
-	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Accept, Origin, User-Agent, Cache-Control, X-Requested-With")
-
-	// Cache CORS preflight requests for 24 hours (86400 seconds).
-	// This reduces the number of OPTIONS requests browsers need to make.
-	w.Header().Set("Access-Control-Max-Age", "86400")
-
-	// Allow browsers to read custom headers in responses.
-	w.Header().Set("Access-Control-Expose-Headers", "*")
-
-	// Help caching work correctly with CORS.
-	// The Vary header tells caches to store separate versions based on these headers.
-	w.Header().Add("Vary", "Origin")
-	w.Header().Add("Vary", "Access-Control-Request-Method")
-	w.Header().Add("Vary", "Access-Control-Request-Headers")
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	flusher, _ := w.(http.Flusher)
+	return &flushWriter{ResponseWriter: w, flusher: flusher}
 }
 
-func handleOptions(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
-	// Handle preflight request.
-	w.WriteHeader(http.StatusOK)
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.ResponseWriter.Write(p)
+	if fw.flusher != nil {
+		fw.flusher.Flush()
+	}
+	return n, err
 }
 
 // proxyRequest is the main function that handles forwarding requests to the target API.
@@ -174,73 +351,42 @@ func handleOptions(w http.ResponseWriter, r *http.Request) {
 // https://developer.mozilla.org/en-US/docs/Web/HTTP/CORS
 func proxyRequest(w http.ResponseWriter, r *http.Request) {
 
-	// Set CORS headers first - security headers should be set early.
-	setCORSHeaders(w)
+	start := time.Now()
 
-	// Handle preflight CORS requests.
-	// Browsers send OPTIONS requests first to check if CORS is allowed.
-	if r.Method == "OPTIONS" {
-		handleOptions(w, r)
-		return
-	}
+	// CORS headers (including preflight) are applied by the cors middleware
+	// before this handler runs.
 
 	// Normalize the URL path to handle trailing slashes consistently.
 	path := strings.TrimPrefix(r.URL.Path, "/")
 	if strings.HasSuffix(r.URL.Path, "/") && !strings.HasSuffix(path, "/") {
 		path += "/"
 	}
-	// Construct the full URL we'll forward to.
-	url := targetURL + "/" + path
-	if r.URL.RawQuery != "" {
-		url += "?" + r.URL.RawQuery
-	}
 
-	// Log details for debugging.
-	log.Printf("Normalized URL: %s", url)
-	log.Printf("Original request Content-Type: %s", r.Header.Get("Content-Type"))
-	log.Printf("Original request Content-Length: %s", r.Header.Get("Content-Length"))
+	isMultipart := strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data")
+	dumpingBodies := activeDump != nil && activeDump.cfg.Bodies && !isMultipart
 
-	// Read and store the body - we need to do this because:
-	// 1. The body can only be read once.
-	// 2. We might need to modify it.
-	// 3. We need to know its size.
-	var bodyData []byte
-	var err error
+	// When there's only one upstream and nothing needs to replay the body,
+	// we pass r.Body straight through without buffering it here. (The mux
+	// handler has already read non-multipart bodies into memory for logging,
+	// so only multipart bodies arrive unread.) Retrying against a
+	// second upstream on dial failure, or dumping the body for -dump, both
+	// need it buffered so it can be read more than once.
+	var bodyBytes []byte
+	var streamBody io.ReadCloser
+	retryable := pool.Retryable()
+	bufferBody := retryable || dumpingBodies
 	if r.Body != nil {
-		bodyData, err = io.ReadAll(r.Body)
-		if err != nil {
-			log.Printf("Error reading request body: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		log.Printf("Read request body (%d bytes): %s", len(bodyData), string(bodyData))
-		r.Body.Close()
-	}
-
-	// Create a new request to our target API.
-	// This is a fresh request that will contain the original request's data.
-	req, err := http.NewRequest(r.Method, url, bytes.NewBuffer(bodyData))
-	if err != nil {
-		log.Printf("Error creating request: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Copy headers but skip "hop-by-hop" headers.
-	// Hop-by-hop headers are meant for a single transport link, not the whole chain.
-	for name, values := range r.Header {
-		if !isHopByHopHeader(name) {
-			for _, value := range values {
-				req.Header.Set(name, value)
+		if bufferBody {
+			var err error
+			bodyBytes, err = io.ReadAll(r.Body)
+			if err != nil {
+				log.Printf("Error reading request body: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
-		}
-	}
-
-	// Ensure proper content length and type for POST requests.
-	if len(bodyData) > 0 {
-		req.ContentLength = int64(len(bodyData))
-		if req.Header.Get("Content-Type") == "" {
-			req.Header.Set("Content-Type", "application/json")
+			r.Body.Close()
+		} else {
+			streamBody = r.Body
 		}
 	}
 
@@ -252,12 +398,100 @@ func proxyRequest(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	// Actually send the request to our target API.
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Error forwarding request: %v", err)
-		// Headers already set at start of function.
-		http.Error(w, err.Error(), http.StatusBadGateway)
+	attempts := 1
+	if retryable {
+		attempts += maxUpstreamRetries
+	}
+
+	var resp *http.Response
+	var lastErr error
+	var upstream *Upstream
+	var lastReq *http.Request
+	for attempt := 0; attempt < attempts; attempt++ {
+		var err error
+		upstream, err = pool.SelectUnderCapacity(r, maxInFlightPerUpstream)
+		if err == errAllUpstreamsBusy {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			log.Printf("No healthy upstream available: %v", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		url := upstream.URL + "/" + path
+		if r.URL.RawQuery != "" {
+			url += "?" + r.URL.RawQuery
+		}
+		log.Printf("Normalized URL: %s (attempt %d/%d)", url, attempt+1, attempts)
+		log.Printf("Original request Content-Type: %s", r.Header.Get("Content-Type"))
+		log.Printf("Original request Content-Length: %s", r.Header.Get("Content-Length"))
+
+		var body io.Reader
+		if bufferBody && bodyBytes != nil {
+			body = bytes.NewReader(bodyBytes)
+		} else if streamBody != nil {
+			body = streamBody
+		}
+
+		// Create a new request to our target API.
+		// This is a fresh request that will contain the original request's data.
+		req, err := http.NewRequest(r.Method, url, body)
+		if err != nil {
+			log.Printf("Error creating request: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		lastReq = req
+
+		// Copy headers but skip "hop-by-hop" headers.
+		// Hop-by-hop headers are meant for a single transport link, not the whole chain.
+		for name, values := range r.Header {
+			if !isHopByHopHeader(name) {
+				for _, value := range values {
+					req.Header.Set(name, value)
+				}
+			}
+		}
+		injectAPIKey(req)
+
+		// Preserve the content length we were given so downstream can still
+		// see it; a negative/unknown ContentLength (chunked request bodies)
+		// is left as-is for Go's transport to negotiate.
+		if len(bodyBytes) > 0 || r.ContentLength > 0 {
+			req.ContentLength = r.ContentLength
+			if req.Header.Get("Content-Type") == "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+		}
+
+		upstream.addInFlight(1)
+		resp, err = client.Do(req)
+		if err != nil {
+			upstream.addInFlight(-1)
+			log.Printf("Error forwarding request to %s: %v", upstream.URL, err)
+			recordUpstreamResult(upstream, 0, err)
+			lastErr = err
+			resp = nil
+			continue
+		}
+		recordUpstreamResult(upstream, resp.StatusCode, nil)
+		// client.Do only blocks for headers, not the body - wrap it so the
+		// upstream stays counted as in-flight for the whole time its
+		// response (e.g. an SSE stream) is being read, not just the
+		// milliseconds it took to get headers back.
+		resp.Body = upstream.trackInFlight(resp.Body)
+		lastErr = nil
+		break
+	}
+
+	if resp == nil {
+		if activeDump != nil && lastReq != nil {
+			activeDump.record(lastReq, bodyBytes, nil, nil, time.Since(start), isMultipart)
+		}
+		http.Error(w, lastErr.Error(), http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
@@ -271,20 +505,48 @@ func proxyRequest(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
-	// Ensure our CORS headers are present.
-	setCORSHeaders(w)
+	// Re-apply our CORS headers in case the upstream's own (now-filtered)
+	// headers would otherwise leave them unset.
+	activeCORS.applyHeaders(w, r)
+
+	streaming := isStreamingResponse(resp)
+	if streaming {
+		// Tell any buffering proxy in front of us (e.g. nginx) to pass
+		// bytes straight through instead of accumulating a full response.
+		w.Header().Set("X-Accel-Buffering", "no")
+	}
 
 	// Log response status.
 	log.Printf("Response status: %d", resp.StatusCode)
 
 	// Send the response status and body back to the original client.
 	w.WriteHeader(resp.StatusCode)
-	written, err := io.Copy(w, resp.Body)
+
+	dst := io.Writer(w)
+	if streaming {
+		dst = newFlushWriter(w)
+	}
+
+	var capture *cappedBuffer
+	if dumpingBodies {
+		capture = &cappedBuffer{max: dumpTruncateBytes}
+		dst = io.MultiWriter(dst, capture)
+	}
+
+	written, err := io.Copy(dst, resp.Body)
 	if err != nil {
 		log.Printf("Error copying response body after %d bytes: %v", written, err)
 	} else {
 		log.Printf("Successfully proxied response: status=%d, bytes=%d", resp.StatusCode, written)
 	}
+
+	if activeDump != nil {
+		var respPreview []byte
+		if capture != nil {
+			respPreview = []byte(capture.String())
+		}
+		activeDump.record(lastReq, bodyBytes, resp, respPreview, time.Since(start), isMultipart)
+	}
 }
 
 // Helper function to check hop-by-hop headers.
@@ -317,16 +579,23 @@ func isHopByHopHeader(header string) bool {
 //   - Handles streaming of file data.
 func handleFileUpload(w http.ResponseWriter, r *http.Request) {
 
-	// Set CORS headers first.
-	setCORSHeaders(w)
+	start := time.Now()
+
+	// CORS headers (including preflight) are applied by the cors middleware
+	// before this handler runs.
 
-	// Handle preflight requests at the beginning.
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
+	upstream, err := pool.SelectUnderCapacity(r, maxInFlightPerUpstream)
+	if err == errAllUpstreamsBusy {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
 		return
 	}
-
-	url := targetURL + r.URL.Path
+	if err != nil {
+		log.Printf("No healthy upstream available: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	url := upstream.URL + r.URL.Path
 
 	client := &http.Client{}
 	req, err := http.NewRequest(r.Method, url, nil)
@@ -341,6 +610,7 @@ func handleFileUpload(w http.ResponseWriter, r *http.Request) {
 			req.Header.Add(name, value)
 		}
 	}
+	injectAPIKey(req)
 
 	// Handle file upload for POST requests.
 	if strings.Contains(r.Method, "POST") {
@@ -382,12 +652,22 @@ func handleFileUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Forward the request to the target API.
+	upstream.addInFlight(1)
 	resp, err := client.Do(req)
 	if err != nil {
-		setCORSHeaders(w)
+		upstream.addInFlight(-1)
+		recordUpstreamResult(upstream, 0, err)
+		if activeDump != nil {
+			activeDump.record(req, nil, nil, nil, time.Since(start), true)
+		}
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
+	recordUpstreamResult(upstream, resp.StatusCode, nil)
+	// See the same wrapping in proxyRequest: keep the upstream counted as
+	// in-flight until its response body is actually closed, not just until
+	// headers arrive.
+	resp.Body = upstream.trackInFlight(resp.Body)
 	defer resp.Body.Close()
 
 	// Copy all headers first.
@@ -400,10 +680,13 @@ func handleFileUpload(w http.ResponseWriter, r *http.Request) {
 	// Then write status code.
 	w.WriteHeader(resp.StatusCode)
 
-	// Finally, copy the body.
+	// Finally, copy the body. File upload bodies are never captured for
+	// dumping - they're multipart and potentially large binary payloads.
 	if _, err = io.Copy(w, resp.Body); err != nil {
 		log.Printf("Error copying response body: %v", err)
-		return
+	}
+	if activeDump != nil {
+		activeDump.record(req, nil, resp, nil, time.Since(start), true)
 	}
 }
 
@@ -418,23 +701,63 @@ func handleFileUpload(w http.ResponseWriter, r *http.Request) {
 //
 // The server will exit with log.Fatal if it fails to start.
 func main() {
-	// Get API server URL from available sources.
-	targetURL, host, port := getTargetURL()
-	log.Printf("Letta API server set to: %s", targetURL)
+	settings := parseSettings()
+	log.Printf("Letta API server(s) set to: %s (lb-policy=%s)", strings.Join(settings.Upstreams, ", "), settings.LBPolicy)
 
-	r := mux.NewRouter()
+	trustedProxies, err := parseTrustedProxies(settings.TrustedProxies)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 
-	// Main request handler for all paths.
-	r.HandleFunc("/{path:.*}", func(w http.ResponseWriter, r *http.Request) {
-		// Set CORS headers immediately.
-		setCORSHeaders(w)
+	pool = NewPool(settings.Upstreams, settings.LBPolicy, trustedProxies)
+	maxUpstreamRetries = settings.LBRetries
+	StartHealthChecker(pool, settings.HealthCheck)
 
-		// Handle OPTIONS requests first.
-		if r.Method == "OPTIONS" {
-			handleOptions(w, r)
-			return
+	activeDump = setupDump(settings.Dump)
+	if activeDump != nil {
+		dumpOutput := settings.Dump.Output
+		if dumpOutput == "" {
+			dumpOutput = "stdout"
 		}
+		log.Printf("Request/response dumping enabled (format=%s, bodies=%v, output=%s)", settings.Dump.Format, settings.Dump.Bodies, dumpOutput)
+	}
 
+	if err := validateCORSConfig(settings.CORS); err != nil {
+		log.Fatalf("%v", err)
+	}
+	activeCORS = newCORS(settings.CORS)
+
+	injectedAPIKey = settings.APIKey
+	clientAuth, err := loadClientAuth(settings.ClientAuthFile)
+	if err != nil {
+		log.Fatalf("Error loading -client-auth-file %q: %v", settings.ClientAuthFile, err)
+	}
+	if clientAuth != nil {
+		log.Printf("Per-client authentication enabled from %s", settings.ClientAuthFile)
+	}
+
+	maxInFlightPerUpstream = settings.MaxInFlight
+
+	if settings.RateLimit > 0 {
+		overrides, err := parseRateLimitOverrides(settings.RateOverrides)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		activeRateLimiter = NewRateLimiter(RateLimitConfig{
+			Limit:          settings.RateLimit,
+			Burst:          settings.RateBurst,
+			Overrides:      overrides,
+			TrustedProxies: trustedProxies,
+		})
+		log.Printf("Rate limiting enabled: %.2f req/s, burst %d, %d path override(s)", settings.RateLimit, settings.RateBurst, len(overrides))
+	}
+
+	host, port := settings.Host, settings.Port
+
+	r := mux.NewRouter()
+
+	// Main request handler for all paths.
+	var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
 		// Request logging.
 		log.Printf("Request: %s %s", r.Method, r.URL.Path)
 		log.Printf("Headers: %v", r.Header)
@@ -460,7 +783,33 @@ func main() {
 			log.Printf("Proxying standard request")
 			proxyRequest(w, r)
 		}
-	})
+	}
+
+	// Client auth wraps the base handler first, then rate limiting wraps
+	// that - so rate limiting sees the client's original Authorization
+	// header (clientAuth.middleware strips it before calling next) and can
+	// key buckets by that presented token rather than just IP.
+	if clientAuth != nil {
+		handler = clientAuth.middleware(handler)
+	}
+	if activeRateLimiter != nil {
+		handler = activeRateLimiter.middleware(handler)
+
+		// The admin endpoint needs its own guard independent of
+		// -client-auth-file, which may not be configured at all - -rate-limit
+		// alone must not leave bucket state open to anyone who can reach the
+		// proxy. It stays disabled until an admin token is set.
+		if settings.AdminToken == "" {
+			log.Printf("Rate limiting enabled but -admin-token is not set; /admin/rate-limits is disabled")
+		} else {
+			adminHandler := adminAuthMiddleware(settings.AdminToken, activeRateLimiter.adminHandler)
+			r.HandleFunc("/admin/rate-limits", activeCORS.middleware(adminHandler))
+		}
+	}
+	// Client authentication and rate limiting both run after CORS, so
+	// preflight requests (which browsers send without credentials) are
+	// never challenged or throttled.
+	r.HandleFunc("/{path:.*}", activeCORS.middleware(handler))
 
 	log.Printf("#################################################")
 	if host == "0.0.0.0" {
@@ -474,8 +823,7 @@ func main() {
 	}
 
 	listenOn := fmt.Sprintf("%s:%d", host, port)
-	err := http.ListenAndServe(listenOn, r)
-	if err != nil {
+	if err := http.ListenAndServe(listenOn, r); err != nil {
 		log.Fatal(err)
 	}
 
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterIdleTTL is how long a client's bucket can sit unused before the
+// background sweep evicts it, keeping the bucket map bounded for an
+// ever-changing population of client IPs/tokens.
+const rateLimiterIdleTTL = 10 * time.Minute
+
+// RateLimitOverride applies a stricter (or looser) limit than the global
+// default to requests whose path starts with Prefix.
+type RateLimitOverride struct {
+	Prefix string
+	Limit  float64
+	Burst  int
+}
+
+// RateLimitConfig configures the rate-limiting middleware.
+type RateLimitConfig struct {
+	Limit          float64
+	Burst          int
+	Overrides      []RateLimitOverride
+	TrustedProxies []*net.IPNet
+}
+
+// clientBucket pairs a token-bucket limiter with the time it was last used,
+// so the background sweep can evict idle clients.
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter rate-limits requests per client identity (the credential the
+// request presents, falling back to IP) with optional per-path-prefix
+// overrides. The credential is not checked against -client-auth-file here.
+type RateLimiter struct {
+	cfg RateLimitConfig
+
+	mu      sync.Mutex
+	buckets map[string]*clientBucket
+}
+
+// NewRateLimiter builds a RateLimiter and starts its idle-bucket sweep.
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	rl := &RateLimiter{cfg: cfg, buckets: make(map[string]*clientBucket)}
+	go rl.sweepLoop()
+	return rl
+}
+
+func (rl *RateLimiter) sweepLoop() {
+	ticker := time.NewTicker(rateLimiterIdleTTL)
+	defer ticker.Stop()
+	for range ticker.C {
+		rl.sweep()
+	}
+}
+
+func (rl *RateLimiter) sweep() {
+	cutoff := time.Now().Add(-rateLimiterIdleTTL)
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for key, b := range rl.buckets {
+		if b.lastSeen.Before(cutoff) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// limitFor returns the limit, burst, and matching override prefix (if any)
+// that applies to path.
+func (rl *RateLimiter) limitFor(path string) (float64, int, string) {
+	for _, o := range rl.cfg.Overrides {
+		if strings.HasPrefix(path, o.Prefix) {
+			return o.Limit, o.Burst, o.Prefix
+		}
+	}
+	return rl.cfg.Limit, rl.cfg.Burst, ""
+}
+
+// bucketFor returns the token bucket for (key, path), creating it on first
+// use. Requests to different override prefixes get independent buckets even
+// for the same client, since they may have different limits.
+func (rl *RateLimiter) bucketFor(key, path string) *rate.Limiter {
+	limit, burst, overridePrefix := rl.limitFor(path)
+	bucketKey := key + "|" + overridePrefix
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b, ok := rl.buckets[bucketKey]
+	if !ok {
+		b = &clientBucket{limiter: rate.NewLimiter(rate.Limit(limit), burst)}
+		rl.buckets[bucketKey] = b
+	}
+	b.lastSeen = time.Now()
+	return b.limiter
+}
+
+// rateLimitKey identifies the client a request should be bucketed under:
+// the bearer token or Basic "user:password" it presents, if any, otherwise
+// its (trusted-proxy-aware) IP address. The credential is used as presented;
+// it is not verified against the known clients.
+func rateLimitKey(r *http.Request, trusted []*net.IPNet) string {
+	if cred := credential(r); cred != "" {
+		return "token:" + cred
+	}
+	return "ip:" + trustedClientIP(r, trusted)
+}
+
+// trustedClientIP returns the client's IP, honoring X-Forwarded-For only
+// when the immediate peer address is in the configured trusted-proxies list.
+func trustedClientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if isTrustedProxy(host, trusted) {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return strings.TrimSpace(strings.Split(xff, ",")[0])
+		}
+	}
+	return host
+}
+
+func isTrustedProxy(ipStr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// middleware rejects requests that exceed their client's token bucket with
+// 429 and a Retry-After header computed from the bucket's refill time.
+func (rl *RateLimiter) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limiter := rl.bucketFor(rateLimitKey(r, rl.cfg.TrustedProxies), r.URL.Path)
+
+		reservation := limiter.Reserve()
+		if !reservation.OK() {
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(delay.Seconds()+1)))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// bucketSnapshot is the JSON shape returned by the admin endpoint for one
+// client bucket.
+type bucketSnapshot struct {
+	Key            string  `json:"key"`
+	TokensAvail    float64 `json:"tokens_available"`
+	LimitPerSecond float64 `json:"limit_per_second"`
+	Burst          int     `json:"burst"`
+}
+
+// snapshot returns the current state of every known client bucket, for the
+// admin endpoint.
+func (rl *RateLimiter) snapshot() []bucketSnapshot {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	snap := make([]bucketSnapshot, 0, len(rl.buckets))
+	for key, b := range rl.buckets {
+		snap = append(snap, bucketSnapshot{
+			Key:            redactBucketKey(key),
+			TokensAvail:    b.limiter.Tokens(),
+			LimitPerSecond: float64(b.limiter.Limit()),
+			Burst:          b.limiter.Burst(),
+		})
+	}
+	return snap
+}
+
+// redactBucketKey masks the raw credential in a "token:<cred>|<prefix>"
+// bucket key before it's exposed over the admin endpoint, replacing the
+// credential with a short hash so operators can still tell buckets apart
+// without the response leaking bearer tokens in the clear. "ip:"-keyed
+// buckets are left as-is, since an IP isn't a secret.
+func redactBucketKey(key string) string {
+	const tokenPrefix = "token:"
+	cred, rest := key, ""
+	if idx := strings.Index(key, "|"); idx >= 0 {
+		cred, rest = key[:idx], key[idx:]
+	}
+	cred, ok := strings.CutPrefix(cred, tokenPrefix)
+	if !ok {
+		return key
+	}
+	sum := sha256.Sum256([]byte(cred))
+	return tokenPrefix + hex.EncodeToString(sum[:6]) + rest
+}
+
+// adminHandler serves the current rate-limit bucket state as JSON, for
+// operators diagnosing why a client is being throttled.
+func (rl *RateLimiter) adminHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rl.snapshot()); err != nil {
+		log.Printf("Error encoding rate limit snapshot: %v", err)
+	}
+}
+
+// adminAuthMiddleware requires the caller to present token as a bearer or
+// Basic credential before reaching next. This guards the admin endpoint on
+// its own, independent of whether -client-auth-file happens to be
+// configured - enabling -rate-limit alone must not leave bucket state
+// (client tokens and IPs) reachable by anyone who can reach the proxy.
+func adminAuthMiddleware(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(credential(r)), []byte(token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// errAllUpstreamsBusy is returned by Pool.SelectUnderCapacity when every
+// healthy upstream is already at its max-in-flight limit.
+var errAllUpstreamsBusy = errors.New("all upstreams are at max in-flight capacity")
+
+// parseRateLimitOverrides parses the -rate-limit-overrides flag, a
+// comma-separated list of "prefix:limit:burst" entries (example:
+// "/v1/agents:2:4,/v1/blocking:1:1").
+func parseRateLimitOverrides(raw string) ([]RateLimitOverride, error) {
+	var overrides []RateLimitOverride
+	for _, entry := range splitCommaList(raw) {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid -rate-limit-overrides entry %q: want prefix:limit:burst", entry)
+		}
+		limit, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit in -rate-limit-overrides entry %q: %w", entry, err)
+		}
+		burst, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid burst in -rate-limit-overrides entry %q: %w", entry, err)
+		}
+		overrides = append(overrides, RateLimitOverride{Prefix: parts[0], Limit: limit, Burst: burst})
+	}
+	return overrides, nil
+}
+
+// parseTrustedProxies parses the -trusted-proxies flag, a comma-separated
+// list of CIDRs.
+func parseTrustedProxies(raw string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range splitCommaList(raw) {
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -trusted-proxies entry %q: %w", entry, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimiterMiddlewareAllowsBurstThenThrottles(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{Limit: 1, Burst: 2})
+
+	called := 0
+	next := func(w http.ResponseWriter, r *http.Request) {
+		called++
+		w.WriteHeader(http.StatusOK)
+	}
+
+	newReq := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/v1/agents", nil)
+		r.RemoteAddr = "203.0.113.9:1234"
+		return r
+	}
+
+	// Burst of 2 should pass immediately.
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		rl.middleware(next)(rw, newReq())
+		if rw.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want %d", i, rw.Code, http.StatusOK)
+		}
+	}
+	if called != 2 {
+		t.Fatalf("next called %d times, want 2", called)
+	}
+
+	// The next request exceeds the burst and should be throttled with a
+	// Retry-After header.
+	rw := httptest.NewRecorder()
+	rl.middleware(next)(rw, newReq())
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("throttled request: got status %d, want %d", rw.Code, http.StatusTooManyRequests)
+	}
+	if rw.Header().Get("Retry-After") == "" {
+		t.Error("throttled request: missing Retry-After header")
+	}
+	if called != 2 {
+		t.Errorf("next called after throttling: got %d calls, want 2 (unchanged)", called)
+	}
+}
+
+func TestRateLimiterMiddlewareKeysByTokenNotIP(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{Limit: 1, Burst: 1})
+
+	next := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	// Same IP, different tokens: each gets its own bucket, so both should
+	// be allowed despite a burst of only 1.
+	for _, token := range []string{"tok-a", "tok-b"} {
+		r := httptest.NewRequest(http.MethodGet, "/v1/agents", nil)
+		r.RemoteAddr = "203.0.113.9:1234"
+		r.Header.Set("Authorization", "Bearer "+token)
+		rw := httptest.NewRecorder()
+		rl.middleware(next)(rw, r)
+		if rw.Code != http.StatusOK {
+			t.Errorf("request with token %q: got status %d, want %d", token, rw.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestRateLimiterBucketForAppliesOverrides(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{
+		Limit: 10,
+		Burst: 10,
+		Overrides: []RateLimitOverride{
+			{Prefix: "/v1/agents", Limit: 1, Burst: 1},
+		},
+	})
+
+	limiter := rl.bucketFor("ip:203.0.113.9", "/v1/agents/123")
+	if got := float64(limiter.Limit()); got != 1 {
+		t.Errorf("bucketFor for an overridden path: got limit %v, want 1", got)
+	}
+
+	limiter = rl.bucketFor("ip:203.0.113.9", "/v1/blocking")
+	if got := float64(limiter.Limit()); got != 10 {
+		t.Errorf("bucketFor for a non-overridden path: got limit %v, want 10 (default)", got)
+	}
+}
+
+func TestRedactBucketKeyMasksToken(t *testing.T) {
+	got := redactBucketKey("token:secrettoken123|/v1/agents")
+	if got == "token:secrettoken123|/v1/agents" {
+		t.Fatal("redactBucketKey did not change a token-keyed bucket key")
+	}
+	if !hasPrefixSuffix(got, "token:", "|/v1/agents") {
+		t.Errorf("redactBucketKey(%q) = %q, want token: prefix and the original path suffix preserved", "token:secrettoken123|/v1/agents", got)
+	}
+}
+
+func TestRedactBucketKeyLeavesIPKeyAlone(t *testing.T) {
+	key := "ip:203.0.113.9|"
+	if got := redactBucketKey(key); got != key {
+		t.Errorf("redactBucketKey(%q) = %q, want unchanged (IPs aren't secrets)", key, got)
+	}
+}
+
+func hasPrefixSuffix(s, prefix, suffix string) bool {
+	return len(s) >= len(prefix)+len(suffix) && s[:len(prefix)] == prefix && s[len(s)-len(suffix):] == suffix
+}
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	called := false
+	next := func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/rate-limits", nil)
+	rw := httptest.NewRecorder()
+	adminAuthMiddleware("s3cret", next)(rw, r)
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("request with no token: got status %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+	if called {
+		t.Error("next was called for a request with no admin token")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/admin/rate-limits", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	rw = httptest.NewRecorder()
+	adminAuthMiddleware("s3cret", next)(rw, r)
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("request with the wrong token: got status %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/admin/rate-limits", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	rw = httptest.NewRecorder()
+	adminAuthMiddleware("s3cret", next)(rw, r)
+	if rw.Code != http.StatusOK {
+		t.Errorf("request with the correct token: got status %d, want %d", rw.Code, http.StatusOK)
+	}
+	if !called {
+		t.Error("next was not called for a request with the correct admin token")
+	}
+}
+
+func TestRateLimiterBucketForSameClientDifferentOverridesAreIndependent(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{
+		Limit: 10,
+		Burst: 10,
+		Overrides: []RateLimitOverride{
+			{Prefix: "/v1/agents", Limit: 1, Burst: 1},
+		},
+	})
+
+	agents := rl.bucketFor("ip:203.0.113.9", "/v1/agents")
+	other := rl.bucketFor("ip:203.0.113.9", "/v1/other")
+	if agents == other {
+		t.Error("bucketFor returned the same bucket for an overridden and a default-limit path")
+	}
+}
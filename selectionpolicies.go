@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// errNoHealthyUpstreams is returned by a SelectionPolicy when every
+// configured upstream is currently unhealthy.
+var errNoHealthyUpstreams = errors.New("no healthy upstreams available")
+
+// SelectionPolicy picks one upstream from a set of healthy candidates for a
+// given request. Implementations must be safe for concurrent use.
+type SelectionPolicy interface {
+	Select(candidates []*Upstream, r *http.Request) (*Upstream, error)
+}
+
+// roundRobinPolicy cycles through healthy upstreams in order.
+type roundRobinPolicy struct {
+	counter uint64
+}
+
+func (p *roundRobinPolicy) Select(candidates []*Upstream, r *http.Request) (*Upstream, error) {
+	if len(candidates) == 0 {
+		return nil, errNoHealthyUpstreams
+	}
+	n := atomic.AddUint64(&p.counter, 1)
+	return candidates[int(n-1)%len(candidates)], nil
+}
+
+// randomPolicy picks a uniformly random healthy upstream.
+type randomPolicy struct{}
+
+func (p *randomPolicy) Select(candidates []*Upstream, r *http.Request) (*Upstream, error) {
+	if len(candidates) == 0 {
+		return nil, errNoHealthyUpstreams
+	}
+	return candidates[rand.Intn(len(candidates))], nil
+}
+
+// leastConnPolicy picks the healthy upstream with the fewest in-flight
+// requests, spreading load away from a backend that's running slow.
+type leastConnPolicy struct{}
+
+func (p *leastConnPolicy) Select(candidates []*Upstream, r *http.Request) (*Upstream, error) {
+	if len(candidates) == 0 {
+		return nil, errNoHealthyUpstreams
+	}
+	best := candidates[0]
+	for _, u := range candidates[1:] {
+		if u.InFlight() < best.InFlight() {
+			best = u
+		}
+	}
+	return best, nil
+}
+
+// ipHashPolicy consistently maps a client address to the same healthy
+// upstream, so a given client keeps talking to the same backend as long as
+// it stays healthy. It honors X-Forwarded-For only from trusted proxies, the
+// same trust model rateLimitKey uses for identifying clients.
+type ipHashPolicy struct {
+	trusted []*net.IPNet
+}
+
+func (p *ipHashPolicy) Select(candidates []*Upstream, r *http.Request) (*Upstream, error) {
+	if len(candidates) == 0 {
+		return nil, errNoHealthyUpstreams
+	}
+	// Score each candidate by hashing the client address with its URL and
+	// pick the highest score, so removing another upstream never remaps a
+	// client whose own upstream is still a candidate.
+	client := trustedClientIP(r, p.trusted)
+	var best *Upstream
+	var bestScore uint32
+	for _, u := range candidates {
+		h := fnv.New32a()
+		h.Write([]byte(client))
+		h.Write([]byte(u.URL))
+		if score := h.Sum32(); best == nil || score > bestScore {
+			best, bestScore = u, score
+		}
+	}
+	return best, nil
+}
+
+// newSelectionPolicy builds the policy named by -lb-policy, defaulting to
+// round_robin for an empty or unrecognized name. trusted is the
+// -trusted-proxies list, used by ip_hash to decide when X-Forwarded-For may
+// be trusted.
+func newSelectionPolicy(name string, trusted []*net.IPNet) SelectionPolicy {
+	switch name {
+	case "random":
+		return &randomPolicy{}
+	case "least_conn":
+		return &leastConnPolicy{}
+	case "ip_hash":
+		return &ipHashPolicy{trusted: trusted}
+	default:
+		return &roundRobinPolicy{}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestUpstreams(n int) []*Upstream {
+	upstreams := make([]*Upstream, n)
+	for i := range upstreams {
+		upstreams[i] = newUpstream("http://upstream")
+	}
+	return upstreams
+}
+
+func TestRoundRobinPolicySelect(t *testing.T) {
+	candidates := newTestUpstreams(3)
+	p := &roundRobinPolicy{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	var got []*Upstream
+	for i := 0; i < 6; i++ {
+		u, err := p.Select(candidates, r)
+		if err != nil {
+			t.Fatalf("Select: %v", err)
+		}
+		got = append(got, u)
+	}
+	for i, u := range got {
+		if want := candidates[i%len(candidates)]; u != want {
+			t.Errorf("call %d: got upstream %p, want %p (cycle should repeat in order)", i, u, want)
+		}
+	}
+}
+
+func TestRoundRobinPolicySelectNoCandidates(t *testing.T) {
+	p := &roundRobinPolicy{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, err := p.Select(nil, r); err != errNoHealthyUpstreams {
+		t.Fatalf("Select with no candidates: got err %v, want errNoHealthyUpstreams", err)
+	}
+}
+
+func TestRandomPolicySelectNoCandidates(t *testing.T) {
+	p := &randomPolicy{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, err := p.Select(nil, r); err != errNoHealthyUpstreams {
+		t.Fatalf("Select with no candidates: got err %v, want errNoHealthyUpstreams", err)
+	}
+}
+
+func TestRandomPolicySelectOnlyChoice(t *testing.T) {
+	candidates := newTestUpstreams(1)
+	p := &randomPolicy{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	u, err := p.Select(candidates, r)
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+	if u != candidates[0] {
+		t.Errorf("Select with one candidate returned a different upstream")
+	}
+}
+
+func TestLeastConnPolicySelect(t *testing.T) {
+	candidates := newTestUpstreams(3)
+	candidates[0].addInFlight(5)
+	candidates[1].addInFlight(2)
+	candidates[2].addInFlight(2)
+	p := &leastConnPolicy{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	u, err := p.Select(candidates, r)
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+	// candidates[1] and candidates[2] are tied at 2 in-flight; the first one
+	// encountered should win.
+	if u != candidates[1] {
+		t.Errorf("Select: got upstream %p, want candidates[1] (first of the tied lowest in-flight)", u)
+	}
+}
+
+func TestLeastConnPolicyAvoidsUpstreamWithOpenStream(t *testing.T) {
+	busy := newUpstream("http://upstream-a")
+	idle := newUpstream("http://upstream-b")
+
+	// Simulate a long-lived streamed response (e.g. SSE) still being read:
+	// trackInFlight keeps busy's count elevated until the body is closed,
+	// not just until headers arrive, so least_conn must still see it as
+	// loaded while the stream is open.
+	busy.addInFlight(1)
+	body := busy.trackInFlight(io.NopCloser(strings.NewReader("")))
+
+	p := &leastConnPolicy{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	u, err := p.Select([]*Upstream{busy, idle}, r)
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+	if u != idle {
+		t.Errorf("Select chose the upstream with an open stream instead of the idle one")
+	}
+
+	if err := body.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if busy.InFlight() != 0 {
+		t.Errorf("InFlight after the stream closes: got %d, want 0", busy.InFlight())
+	}
+}
+
+func TestLeastConnPolicySelectNoCandidates(t *testing.T) {
+	p := &leastConnPolicy{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, err := p.Select(nil, r); err != errNoHealthyUpstreams {
+		t.Fatalf("Select with no candidates: got err %v, want errNoHealthyUpstreams", err)
+	}
+}
+
+func TestIPHashPolicySelectConsistent(t *testing.T) {
+	candidates := newTestUpstreams(4)
+	p := &ipHashPolicy{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.5:54321"
+
+	first, err := p.Select(candidates, r)
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		u, err := p.Select(candidates, r)
+		if err != nil {
+			t.Fatalf("Select: %v", err)
+		}
+		if u != first {
+			t.Fatalf("Select for the same client address returned different upstreams across calls")
+		}
+	}
+}
+
+func TestIPHashPolicySelectUntrustedForwardedForIgnored(t *testing.T) {
+	candidates := newTestUpstreams(4)
+	p := &ipHashPolicy{} // no trusted proxies configured
+
+	direct := httptest.NewRequest(http.MethodGet, "/", nil)
+	direct.RemoteAddr = "203.0.113.5:54321"
+	want, err := p.Select(candidates, direct)
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+
+	spoofed := httptest.NewRequest(http.MethodGet, "/", nil)
+	spoofed.RemoteAddr = "203.0.113.5:54321"
+	spoofed.Header.Set("X-Forwarded-For", "198.51.100.9")
+	got, err := p.Select(candidates, spoofed)
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+	if got != want {
+		t.Errorf("Select honored X-Forwarded-For from an untrusted peer, got different upstream")
+	}
+}
+
+func TestIPHashPolicySelectTrustedForwardedForHonored(t *testing.T) {
+	_, trustedNet, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("ParseCIDR: %v", err)
+	}
+	candidates := newTestUpstreams(4)
+	p := &ipHashPolicy{trusted: []*net.IPNet{trustedNet}}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:54321"
+	r.Header.Set("X-Forwarded-For", "198.51.100.9")
+	viaForwarded, err := p.Select(candidates, r)
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+
+	direct := httptest.NewRequest(http.MethodGet, "/", nil)
+	direct.RemoteAddr = "198.51.100.9:1"
+	want, err := p.Select(candidates, direct)
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+	if viaForwarded != want {
+		t.Errorf("Select from a trusted proxy did not hash on the forwarded client address")
+	}
+}
+
+func TestIPHashPolicySelectNoCandidates(t *testing.T) {
+	p := &ipHashPolicy{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, err := p.Select(nil, r); err != errNoHealthyUpstreams {
+		t.Fatalf("Select with no candidates: got err %v, want errNoHealthyUpstreams", err)
+	}
+}
+
+func TestNewSelectionPolicy(t *testing.T) {
+	cases := map[string]SelectionPolicy{
+		"round_robin": &roundRobinPolicy{},
+		"random":      &randomPolicy{},
+		"least_conn":  &leastConnPolicy{},
+		"ip_hash":     &ipHashPolicy{},
+		"":            &roundRobinPolicy{},
+		"bogus":       &roundRobinPolicy{},
+	}
+	for name, want := range cases {
+		got := newSelectionPolicy(name, nil)
+		if wantType, gotType := typeName(want), typeName(got); gotType != wantType {
+			t.Errorf("newSelectionPolicy(%q) = %s, want %s", name, gotType, wantType)
+		}
+	}
+}
+
+func typeName(p SelectionPolicy) string {
+	switch p.(type) {
+	case *roundRobinPolicy:
+		return "roundRobinPolicy"
+	case *randomPolicy:
+		return "randomPolicy"
+	case *leastConnPolicy:
+		return "leastConnPolicy"
+	case *ipHashPolicy:
+		return "ipHashPolicy"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Upstream represents a single Letta backend the proxy can forward requests
+// to. Its health and in-flight count are updated concurrently by request
+// handlers and the background health checker, so both fields are accessed
+// atomically rather than behind the pool's lock.
+type Upstream struct {
+	URL string
+
+	healthy  int32 // 1 = healthy, 0 = unhealthy; read/written atomically.
+	inFlight int64 // requests currently being proxied to this upstream.
+}
+
+func newUpstream(rawURL string) *Upstream {
+	return &Upstream{URL: strings.TrimSuffix(rawURL, "/"), healthy: 1}
+}
+
+// IsHealthy reports whether the upstream should currently be considered for
+// selection.
+func (u *Upstream) IsHealthy() bool {
+	return atomic.LoadInt32(&u.healthy) == 1
+}
+
+func (u *Upstream) setHealthy(healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&u.healthy, v)
+}
+
+// InFlight returns the number of requests currently being proxied to this
+// upstream. Used by the least_conn selection policy.
+func (u *Upstream) InFlight() int64 {
+	return atomic.LoadInt64(&u.inFlight)
+}
+
+func (u *Upstream) addInFlight(delta int64) {
+	atomic.AddInt64(&u.inFlight, delta)
+}
+
+// inFlightBody wraps a response body so u's in-flight count is released when
+// the body is closed, rather than by the caller decrementing it as soon as
+// client.Do returns. client.Do only blocks for headers, so for a streamed
+// response (e.g. SSE) the body can still be getting copied to the client
+// long after that; trackInFlight keeps it counted for that whole window.
+type inFlightBody struct {
+	io.ReadCloser
+	u    *Upstream
+	once sync.Once
+}
+
+func (b *inFlightBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.u.addInFlight(-1) })
+	return err
+}
+
+// trackInFlight does not change u's in-flight count itself - the caller
+// must already have called u.addInFlight(1) - and returns body wrapped so
+// that count is released on Close instead of immediately.
+func (u *Upstream) trackInFlight(body io.ReadCloser) io.ReadCloser {
+	return &inFlightBody{ReadCloser: body, u: u}
+}
+
+// Pool holds the configured set of upstream Letta backends along with the
+// selection policy used to pick one per request.
+type Pool struct {
+	mu        sync.RWMutex
+	upstreams []*Upstream
+	policy    SelectionPolicy
+}
+
+// NewPool builds a Pool from a list of backend URLs and the name of the
+// selection policy to use (see newSelectionPolicy). trustedProxies is passed
+// through to the policy, for ip_hash's X-Forwarded-For trust decision.
+func NewPool(urls []string, policyName string, trustedProxies []*net.IPNet) *Pool {
+	upstreams := make([]*Upstream, 0, len(urls))
+	for _, u := range urls {
+		upstreams = append(upstreams, newUpstream(u))
+	}
+	return &Pool{upstreams: upstreams, policy: newSelectionPolicy(policyName, trustedProxies)}
+}
+
+// Upstreams returns every configured upstream, healthy or not. Used by the
+// health checker, which needs to probe unhealthy backends too.
+func (p *Pool) Upstreams() []*Upstream {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.upstreams
+}
+
+// Healthy returns the subset of upstreams currently marked healthy.
+func (p *Pool) Healthy() []*Upstream {
+	all := p.Upstreams()
+	healthy := make([]*Upstream, 0, len(all))
+	for _, u := range all {
+		if u.IsHealthy() {
+			healthy = append(healthy, u)
+		}
+	}
+	return healthy
+}
+
+// Retryable reports whether it's worth buffering a request body so it can be
+// replayed against a second upstream on failure - i.e. there's more than one
+// backend configured.
+func (p *Pool) Retryable() bool {
+	return len(p.Upstreams()) > 1
+}
+
+// Select picks an upstream for r using the pool's configured policy,
+// considering only currently healthy upstreams.
+func (p *Pool) Select(r *http.Request) (*Upstream, error) {
+	return p.policy.Select(p.Healthy(), r)
+}
+
+// SelectUnderCapacity is like Select, but also excludes healthy upstreams
+// that already have maxInFlight or more requests in progress. It returns
+// errAllUpstreamsBusy (distinct from "no healthy upstreams") so callers can
+// respond 429 rather than 502 when the backends are simply overloaded.
+// maxInFlight <= 0 disables the cap, behaving exactly like Select.
+func (p *Pool) SelectUnderCapacity(r *http.Request, maxInFlight int) (*Upstream, error) {
+	healthy := p.Healthy()
+	if maxInFlight <= 0 {
+		return p.policy.Select(healthy, r)
+	}
+
+	underCapacity := make([]*Upstream, 0, len(healthy))
+	for _, u := range healthy {
+		if u.InFlight() < int64(maxInFlight) {
+			underCapacity = append(underCapacity, u)
+		}
+	}
+	if len(underCapacity) == 0 {
+		if len(healthy) == 0 {
+			return nil, errNoHealthyUpstreams
+		}
+		return nil, errAllUpstreamsBusy
+	}
+	return p.policy.Select(underCapacity, r)
+}
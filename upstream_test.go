@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPoolSelectUnderCapacityNoHealthyUpstreams(t *testing.T) {
+	pool := NewPool([]string{"http://a", "http://b"}, "round_robin", nil)
+	for _, u := range pool.Upstreams() {
+		u.setHealthy(false)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if _, err := pool.SelectUnderCapacity(r, 0); err != errNoHealthyUpstreams {
+		t.Fatalf("SelectUnderCapacity with no healthy upstreams: got err %v, want errNoHealthyUpstreams", err)
+	}
+}
+
+func TestPoolSelectUnderCapacityExhausted(t *testing.T) {
+	pool := NewPool([]string{"http://a", "http://b"}, "round_robin", nil)
+	for _, u := range pool.Upstreams() {
+		u.addInFlight(2)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if _, err := pool.SelectUnderCapacity(r, 2); err != errAllUpstreamsBusy {
+		t.Fatalf("SelectUnderCapacity with every upstream at capacity: got err %v, want errAllUpstreamsBusy", err)
+	}
+}
+
+func TestPoolSelectUnderCapacitySkipsBusyUpstream(t *testing.T) {
+	pool := NewPool([]string{"http://a", "http://b"}, "round_robin", nil)
+	upstreams := pool.Upstreams()
+	upstreams[0].addInFlight(2)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	u, err := pool.SelectUnderCapacity(r, 2)
+	if err != nil {
+		t.Fatalf("SelectUnderCapacity: %v", err)
+	}
+	if u != upstreams[1] {
+		t.Errorf("SelectUnderCapacity picked the upstream already at capacity instead of the one with headroom")
+	}
+}
+
+func TestPoolSelectUnderCapacityUncapped(t *testing.T) {
+	pool := NewPool([]string{"http://a"}, "round_robin", nil)
+	upstreams := pool.Upstreams()
+	upstreams[0].addInFlight(1000)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// maxInFlight <= 0 disables the cap entirely.
+	u, err := pool.SelectUnderCapacity(r, 0)
+	if err != nil {
+		t.Fatalf("SelectUnderCapacity: %v", err)
+	}
+	if u != upstreams[0] {
+		t.Errorf("SelectUnderCapacity with cap disabled did not return the only upstream")
+	}
+}
+
+func TestPoolRetryable(t *testing.T) {
+	if (NewPool([]string{"http://a"}, "round_robin", nil)).Retryable() {
+		t.Error("Retryable with a single upstream: got true, want false")
+	}
+	if !(NewPool([]string{"http://a", "http://b"}, "round_robin", nil)).Retryable() {
+		t.Error("Retryable with two upstreams: got false, want true")
+	}
+}